@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Saturn745/digitalmatter-traccar/protocol"
+)
+
+// captureFrameHeaderLen is the length-prefixed framing written ahead of each
+// captured chunk: an 8-byte monotonic microsecond timestamp followed by a
+// 4-byte chunk length.
+const captureFrameHeaderLen = 8 + 4
+
+// captureWriter records one connection's raw inbound byte stream to a file
+// under CAPTURE_DIR, named by device IMEI and connection start time so field
+// traces can be matched back to a tracker later. The IMEI isn't known until
+// a protocol has parsed enough of the stream to identify the device, so the
+// file starts out named by remote address and is renamed in place once the
+// IMEI shows up.
+type captureWriter struct {
+	mu         sync.Mutex
+	dir        string
+	startTime  time.Time
+	remoteAddr string
+	imei       string
+	file       *os.File
+}
+
+func newCaptureWriter(dir, remoteAddr string) *captureWriter {
+	return &captureWriter{
+		dir:        dir,
+		startTime:  time.Now(),
+		remoteAddr: remoteAddr,
+	}
+}
+
+func (w *captureWriter) filename() string {
+	name := w.imei
+	if name == "" {
+		name = w.remoteAddr
+	}
+	return fmt.Sprintf("%s_%s.cap", sanitizeFilename(name), w.startTime.UTC().Format("20060102T150405.000000"))
+}
+
+func (w *captureWriter) ensureOpenLocked() error {
+	if w.file != nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(w.dir, 0755); err != nil {
+		return err
+	}
+
+	f, err := os.Create(filepath.Join(w.dir, w.filename()))
+	if err != nil {
+		return err
+	}
+
+	w.file = f
+	return nil
+}
+
+// SetIMEI renames the capture file in place once a protocol has identified
+// the device. A no-op once the IMEI is already known.
+func (w *captureWriter) SetIMEI(imei string) {
+	if imei == "" {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.imei != "" {
+		return
+	}
+	if w.file == nil {
+		w.imei = imei
+		return
+	}
+
+	oldPath := w.file.Name()
+	w.imei = imei
+	newPath := filepath.Join(w.dir, w.filename())
+
+	if err := w.file.Close(); err != nil {
+		log.Printf("capture: failed to close %s for rename: %v", oldPath, err)
+		return
+	}
+	if err := os.Rename(oldPath, newPath); err != nil {
+		log.Printf("capture: failed to rename %s to %s: %v", oldPath, newPath, err)
+		return
+	}
+
+	f, err := os.OpenFile(newPath, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("capture: failed to reopen %s: %v", newPath, err)
+		return
+	}
+	w.file = f
+}
+
+// Write appends a chunk to the capture file as [8-byte microsecond
+// timestamp][4-byte length][data].
+func (w *captureWriter) Write(chunk []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.ensureOpenLocked(); err != nil {
+		return 0, err
+	}
+
+	var header [captureFrameHeaderLen]byte
+	binary.BigEndian.PutUint64(header[0:8], uint64(time.Now().UnixMicro()))
+	binary.BigEndian.PutUint32(header[8:12], uint32(len(chunk)))
+
+	if _, err := w.file.Write(header[:]); err != nil {
+		return 0, err
+	}
+	return w.file.Write(chunk)
+}
+
+func (w *captureWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return nil
+	}
+	return w.file.Close()
+}
+
+func sanitizeFilename(s string) string {
+	out := make([]rune, 0, len(s))
+	for _, r := range s {
+		if r == '/' || r == '\\' || r == ':' {
+			out = append(out, '_')
+			continue
+		}
+		out = append(out, r)
+	}
+	return string(out)
+}
+
+// recordingConn tees every byte read from conn into a captureWriter.
+type recordingConn struct {
+	net.Conn
+	writer *captureWriter
+}
+
+func (r *recordingConn) Read(p []byte) (int, error) {
+	n, err := r.Conn.Read(p)
+	if n > 0 {
+		if _, werr := r.writer.Write(p[:n]); werr != nil {
+			log.Printf("capture: write error for %s: %v", r.RemoteAddr(), werr)
+		}
+	}
+	return n, err
+}
+
+// captureSink wraps a PositionSink so the first IMEI a protocol reports for
+// a connection also names that connection's capture file.
+type captureSink struct {
+	inner  protocol.PositionSink
+	writer *captureWriter
+}
+
+func (s *captureSink) Forward(pos protocol.Position) error {
+	s.writer.SetIMEI(pos.IMEI)
+	return s.inner.Forward(pos)
+}
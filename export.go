@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// ExportOptions selects the records an export dumps from a data log.
+type ExportOptions struct {
+	DBPath string
+	IMEI   string
+	Format string // "csv" or "gpx"
+	From   time.Time
+	To     time.Time
+	Out    string // "" means stdout
+}
+
+type exportedPosition struct {
+	Timestamp   int64
+	Latitude    float64
+	Longitude   float64
+	Altitude    float64
+	GroundSpeed float64
+	Heading     float64
+}
+
+// parseExportOptions validates the -export CLI flags into ExportOptions.
+func parseExportOptions(dbPath, imei, format, from, to, out string) (ExportOptions, error) {
+	if imei == "" {
+		return ExportOptions{}, fmt.Errorf("-export-imei is required")
+	}
+
+	opts := ExportOptions{
+		DBPath: dbPath,
+		IMEI:   imei,
+		Format: format,
+		From:   time.Unix(0, 0).UTC(),
+		To:     time.Now().UTC(),
+		Out:    out,
+	}
+
+	if from != "" {
+		parsed, err := time.Parse(time.RFC3339, from)
+		if err != nil {
+			return ExportOptions{}, fmt.Errorf("-export-from: %w", err)
+		}
+		opts.From = parsed
+	}
+
+	if to != "" {
+		parsed, err := time.Parse(time.RFC3339, to)
+		if err != nil {
+			return ExportOptions{}, fmt.Errorf("-export-to: %w", err)
+		}
+		opts.To = parsed
+	}
+
+	return opts, nil
+}
+
+// runExport dumps a DATA_LOG_PATH database to CSV or GPX for one IMEI over a
+// time range, so tracks can be inspected without standing up Traccar.
+func runExport(opts ExportOptions) error {
+	db, err := sql.Open("sqlite3", opts.DBPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(
+		`SELECT timestamp, latitude, longitude, altitude, ground_speed, heading
+		 FROM records WHERE imei = ? AND timestamp BETWEEN ? AND ?
+		 ORDER BY timestamp`,
+		opts.IMEI, opts.From.Unix(), opts.To.Unix(),
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var positions []exportedPosition
+	for rows.Next() {
+		var p exportedPosition
+		if err := rows.Scan(&p.Timestamp, &p.Latitude, &p.Longitude, &p.Altitude, &p.GroundSpeed, &p.Heading); err != nil {
+			return err
+		}
+		positions = append(positions, p)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	out := io.Writer(os.Stdout)
+	if opts.Out != "" {
+		f, err := os.Create(opts.Out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	switch opts.Format {
+	case "gpx":
+		return exportGPX(out, opts.IMEI, positions)
+	case "csv", "":
+		return exportCSV(out, positions)
+	default:
+		return fmt.Errorf("unsupported export format %q (want csv or gpx)", opts.Format)
+	}
+}
+
+func exportCSV(out io.Writer, positions []exportedPosition) error {
+	w := csv.NewWriter(out)
+	defer w.Flush()
+
+	if err := w.Write([]string{"timestamp", "latitude", "longitude", "altitude", "ground_speed", "heading"}); err != nil {
+		return err
+	}
+
+	for _, p := range positions {
+		record := []string{
+			time.Unix(p.Timestamp, 0).UTC().Format(time.RFC3339),
+			strconv.FormatFloat(p.Latitude, 'f', 6, 64),
+			strconv.FormatFloat(p.Longitude, 'f', 6, 64),
+			strconv.FormatFloat(p.Altitude, 'f', 1, 64),
+			strconv.FormatFloat(p.GroundSpeed, 'f', 1, 64),
+			strconv.FormatFloat(p.Heading, 'f', 1, 64),
+		}
+		if err := w.Write(record); err != nil {
+			return err
+		}
+	}
+
+	return w.Error()
+}
+
+func exportGPX(out io.Writer, imei string, positions []exportedPosition) error {
+	if _, err := fmt.Fprintf(out, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n"+
+		"<gpx version=\"1.1\" creator=\"digitalmatter-traccar\" xmlns=\"http://www.topografix.com/GPX/1/1\">\n"+
+		"  <trk>\n    <name>%s</name>\n    <trkseg>\n", escapeXMLText(imei)); err != nil {
+		return err
+	}
+
+	for _, p := range positions {
+		if _, err := fmt.Fprintf(out,
+			"      <trkpt lat=\"%.6f\" lon=\"%.6f\"><ele>%.1f</ele><time>%s</time></trkpt>\n",
+			p.Latitude, p.Longitude, p.Altitude, time.Unix(p.Timestamp, 0).UTC().Format(time.RFC3339),
+		); err != nil {
+			return err
+		}
+	}
+
+	_, err := fmt.Fprint(out, "    </trkseg>\n  </trk>\n</gpx>\n")
+	return err
+}
+
+// escapeXMLText escapes s for safe use as GPX element text. imei comes from
+// the device over the wire, so it can't be trusted to be XML-safe as-is.
+func escapeXMLText(s string) string {
+	var buf bytes.Buffer
+	if err := xml.EscapeText(&buf, []byte(s)); err != nil {
+		return s
+	}
+	return buf.String()
+}
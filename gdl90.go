@@ -0,0 +1,225 @@
+package main
+
+import (
+	"hash/fnv"
+	"log"
+	"math"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/Saturn745/digitalmatter-traccar/protocol"
+)
+
+// GDL90 message IDs we emit.
+const (
+	GDL90_MSG_HEARTBEAT = 0x00
+	GDL90_MSG_OWNSHIP   = 0x0A
+
+	gdl90FlagByte = 0x7E
+	gdl90EscByte  = 0x7D
+)
+
+var gdl90CRCTable [256]uint16
+
+func init() {
+	for i := 0; i < 256; i++ {
+		crc := uint16(i) << 8
+		for b := 0; b < 8; b++ {
+			if crc&0x8000 != 0 {
+				crc = (crc << 1) ^ 0x1021
+			} else {
+				crc = crc << 1
+			}
+		}
+		gdl90CRCTable[i] = crc
+	}
+}
+
+func gdl90CRC(data []byte) uint16 {
+	crc := uint16(0)
+	for _, b := range data {
+		m := (crc << 8) & 0xFFFF
+		crc = gdl90CRCTable[crc>>8] ^ m ^ uint16(b)
+	}
+	return crc
+}
+
+// gdl90Frame wraps msgID+payload in 0x7E ... 0x7E with byte stuffing and a
+// little-endian CRC16-CCITT, matching the framing Stratux uses.
+func gdl90Frame(msgID byte, payload []byte) []byte {
+	message := make([]byte, 0, len(payload)+1)
+	message = append(message, msgID)
+	message = append(message, payload...)
+
+	crc := gdl90CRC(message)
+	message = append(message, byte(crc&0xFF), byte(crc>>8))
+
+	framed := make([]byte, 0, len(message)*2+2)
+	framed = append(framed, gdl90FlagByte)
+	for _, b := range message {
+		if b == gdl90FlagByte || b == gdl90EscByte {
+			framed = append(framed, gdl90EscByte, b^0x20)
+		} else {
+			framed = append(framed, b)
+		}
+	}
+	framed = append(framed, gdl90FlagByte)
+
+	return framed
+}
+
+func gdl90Heartbeat(t time.Time) []byte {
+	payload := make([]byte, 6)
+	payload[0] = 0x81 // GPS position valid, UAT initialized
+	payload[1] = 0x01 // UTC OK
+
+	secsSinceMidnight := t.Hour()*3600 + t.Minute()*60 + t.Second()
+	if secsSinceMidnight >= 0x10000 {
+		payload[1] |= 0x80
+	}
+	payload[2] = byte(secsSinceMidnight & 0xFF)
+	payload[3] = byte((secsSinceMidnight >> 8) & 0xFF)
+	// message counts (uplink/basic+long) are left at zero - we don't receive UAT traffic.
+
+	return gdl90Frame(GDL90_MSG_HEARTBEAT, payload)
+}
+
+// icaoAddressFromIMEI derives a stable pseudo-ICAO address from a device
+// IMEI so each tracker shows up as a consistent ownship target.
+func icaoAddressFromIMEI(imei string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(imei))
+	return h.Sum32() & 0xFFFFFF
+}
+
+func gdl90EncodeLat(lat float64) int32 {
+	return int32(lat / (180.0 / 8388608.0))
+}
+
+func gdl90EncodeLon(lon float64) int32 {
+	return int32(lon / (180.0 / 8388608.0))
+}
+
+// gdl90OwnshipReport builds the 27-byte Ownship Report payload for a GPS fix.
+func gdl90OwnshipReport(pos protocol.Position) []byte {
+	payload := make([]byte, 27)
+
+	addrType := byte(0) // ADS-B with ICAO address
+	payload[0] = addrType & 0x0F
+
+	icao := icaoAddressFromIMEI(pos.IMEI)
+	payload[1] = byte(icao >> 16)
+	payload[2] = byte(icao >> 8)
+	payload[3] = byte(icao)
+
+	lat := uint32(gdl90EncodeLat(pos.Latitude)) & 0xFFFFFF
+	payload[4] = byte(lat >> 16)
+	payload[5] = byte(lat >> 8)
+	payload[6] = byte(lat)
+
+	lon := uint32(gdl90EncodeLon(pos.Longitude)) & 0xFFFFFF
+	payload[7] = byte(lon >> 16)
+	payload[8] = byte(lon >> 8)
+	payload[9] = byte(lon)
+
+	altFt := int(math.Round(pos.Altitude * 3.28084))
+	altEnc := (altFt + 1000) / 25
+	if altEnc < 0 {
+		altEnc = 0xFFF // "unavailable"
+	} else if altEnc > 0xFFE {
+		altEnc = 0xFFE
+	}
+	payload[10] = byte(altEnc >> 4)
+	payload[11] = byte((altEnc&0x0F)<<4) | 0x09 // airborne, NIC/NACp supplied below
+
+	nic := byte(8)
+	nacp := byte(8)
+	payload[12] = (nic << 4) | nacp
+
+	speedKnots := uint16(math.Round(pos.GroundSpeed))
+	if speedKnots > 0xFFE {
+		speedKnots = 0xFFE
+	}
+	payload[13] = byte(speedKnots >> 4)
+
+	vertVelocity := uint16(0x800) // "no vertical rate information"
+	payload[14] = byte((speedKnots&0x0F)<<4) | byte(vertVelocity>>8)
+	payload[15] = byte(vertVelocity)
+
+	payload[16] = byte(math.Round(pos.Heading * 256.0 / 360.0))
+
+	payload[17] = 0x01 // emitter category: light aircraft
+
+	callSign := strings.ToUpper(pos.IMEI)
+	if len(callSign) > 8 {
+		callSign = callSign[:8]
+	}
+	copy(payload[18:26], []byte(callSign))
+	for i := 18 + len(callSign); i < 26; i++ {
+		payload[i] = ' '
+	}
+
+	payload[26] = 0x00
+
+	return gdl90Frame(GDL90_MSG_OWNSHIP, payload)
+}
+
+// gdl90Sender broadcasts ownship reports and a once-per-second heartbeat to
+// the configured EFB client targets over UDP.
+type gdl90Sender struct {
+	conns []net.Conn
+}
+
+func startGDL90Sender(config Config) *gdl90Sender {
+	if !config.GDL90Enabled {
+		return nil
+	}
+
+	sender := &gdl90Sender{}
+	for _, target := range config.GDL90Targets {
+		conn, err := net.Dial("udp", target)
+		if err != nil {
+			log.Printf("GDL90: failed to dial target %s: %v", target, err)
+			continue
+		}
+		sender.conns = append(sender.conns, conn)
+	}
+
+	if len(sender.conns) == 0 {
+		log.Printf("GDL90 enabled but no targets could be reached")
+		return sender
+	}
+
+	go sender.heartbeatLoop()
+
+	log.Printf("GDL90 output enabled, broadcasting to %d target(s)", len(sender.conns))
+
+	return sender
+}
+
+func (s *gdl90Sender) heartbeatLoop() {
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		s.broadcast(gdl90Heartbeat(now.UTC()))
+	}
+}
+
+func (s *gdl90Sender) broadcast(frame []byte) {
+	for _, conn := range s.conns {
+		if _, err := conn.Write(frame); err != nil {
+			log.Printf("GDL90: write to %s failed: %v", conn.RemoteAddr(), err)
+		}
+	}
+}
+
+// Forward implements protocol.PositionSink.
+func (s *gdl90Sender) Forward(pos protocol.Position) error {
+	if s == nil || len(s.conns) == 0 || pos.IMEI == "" {
+		return nil
+	}
+	s.broadcast(gdl90OwnshipReport(pos))
+	return nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/Saturn745/digitalmatter-traccar/protocol"
+)
+
+func TestGDL90FrameByteStuffing(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+	}{
+		{"no special bytes", []byte{0x01, 0x02, 0x03}},
+		{"contains flag byte", []byte{0x7E, 0x01}},
+		{"contains escape byte", []byte{0x7D, 0x02}},
+		{"contains both", []byte{0x7E, 0x7D, 0x7E}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			framed := gdl90Frame(0x00, tt.payload)
+
+			if framed[0] != gdl90FlagByte || framed[len(framed)-1] != gdl90FlagByte {
+				t.Fatalf("frame not bracketed by flag bytes: % x", framed)
+			}
+
+			for _, b := range framed[1 : len(framed)-1] {
+				if b == gdl90FlagByte {
+					t.Fatalf("unescaped flag byte inside frame body: % x", framed)
+				}
+			}
+		})
+	}
+}
+
+func TestGDL90CRCKnownVector(t *testing.T) {
+	// The CRC-16/CCITT-style table in gdl90.go is seeded and walked the same
+	// way as Stratux's reference implementation; a zero-length message's CRC
+	// must be zero since there are no bytes to fold in.
+	if crc := gdl90CRC(nil); crc != 0 {
+		t.Errorf("gdl90CRC(nil) = %#04x, want 0", crc)
+	}
+
+	a := gdl90CRC([]byte{0x00, 0x81, 0x01})
+	b := gdl90CRC([]byte{0x00, 0x81, 0x02})
+	if a == b {
+		t.Errorf("gdl90CRC produced the same value for different inputs: %#04x", a)
+	}
+}
+
+func TestGDL90EncodeLatLon(t *testing.T) {
+	tests := []struct {
+		lat, lon float64
+	}{
+		{0, 0},
+		{45.0, -122.5},
+		{-33.9, 151.2},
+	}
+
+	for _, tt := range tests {
+		lat := gdl90EncodeLat(tt.lat)
+		lon := gdl90EncodeLon(tt.lon)
+
+		gotLat := float64(lat) * (180.0 / 8388608.0)
+		gotLon := float64(lon) * (180.0 / 8388608.0)
+
+		if diff := gotLat - tt.lat; diff > 0.001 || diff < -0.001 {
+			t.Errorf("gdl90EncodeLat(%v) round-trips to %v, want within 0.001", tt.lat, gotLat)
+		}
+		if diff := gotLon - tt.lon; diff > 0.001 || diff < -0.001 {
+			t.Errorf("gdl90EncodeLon(%v) round-trips to %v, want within 0.001", tt.lon, gotLon)
+		}
+	}
+}
+
+func TestICAOAddressFromIMEIIsStable(t *testing.T) {
+	imei := "123456789012345"
+
+	first := icaoAddressFromIMEI(imei)
+	second := icaoAddressFromIMEI(imei)
+	if first != second {
+		t.Fatalf("icaoAddressFromIMEI(%q) is not deterministic: %#x != %#x", imei, first, second)
+	}
+
+	if first&^0xFFFFFF != 0 {
+		t.Fatalf("icaoAddressFromIMEI(%q) = %#x, want a 24-bit address", imei, first)
+	}
+
+	if other := icaoAddressFromIMEI("000000000000000"); other == first {
+		t.Fatalf("icaoAddressFromIMEI produced the same address for different IMEIs: %#x", first)
+	}
+}
+
+func TestGDL90HeartbeatIsFramed(t *testing.T) {
+	frame := gdl90Heartbeat(time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC))
+	if !bytes.HasPrefix(frame, []byte{gdl90FlagByte}) || !bytes.HasSuffix(frame, []byte{gdl90FlagByte}) {
+		t.Fatalf("heartbeat frame not properly bracketed: % x", frame)
+	}
+
+	// The spec's Heartbeat message is 7 bytes total: a 1-byte message ID
+	// followed by a 6-byte payload (2 status + 2 timestamp + 2 message
+	// counts). gdl90Frame appends msgID+CRC16 on top of the payload we pass
+	// it, so the unstuffed message here must be 1+6+2 = 9 bytes.
+	message := gdl90Unstuff(t, frame)
+	if len(message) != 9 {
+		t.Fatalf("heartbeat message is %d bytes unstuffed, want 9 (1 msgID + 6 payload + 2 CRC)", len(message))
+	}
+}
+
+func TestGDL90OwnshipReportGroundSpeedIsKnots(t *testing.T) {
+	// protocol.Position.GroundSpeed is plain knots (see forwardToTraccar,
+	// which passes it straight through as Traccar's knots parameter), and
+	// the Ownship Report's horizontal-velocity field is itself 1-knot
+	// resolution, so no scaling should happen between the two.
+	pos := protocol.Position{IMEI: "123456789012345", GroundSpeed: 120}
+
+	message := gdl90Unstuff(t, gdl90OwnshipReport(pos))
+	if len(message) < 16 {
+		t.Fatalf("ownship message too short: % x", message)
+	}
+
+	// payload starts at message[1]; the 12-bit speed field spans
+	// payload[13] (high 8 bits) and the top nibble of payload[14].
+	speedKnots := uint16(message[1+13])<<4 | uint16(message[1+14])>>4
+	if speedKnots != 120 {
+		t.Errorf("encoded ground speed = %d knots, want 120", speedKnots)
+	}
+}
+
+// gdl90Unstuff strips the flag bytes and byte-stuffing gdl90Frame applies, so
+// tests can assert on the underlying message length and bytes.
+func gdl90Unstuff(t *testing.T, frame []byte) []byte {
+	t.Helper()
+
+	if len(frame) < 2 || frame[0] != gdl90FlagByte || frame[len(frame)-1] != gdl90FlagByte {
+		t.Fatalf("frame not bracketed by flag bytes: % x", frame)
+	}
+
+	body := frame[1 : len(frame)-1]
+	message := make([]byte, 0, len(body))
+	for i := 0; i < len(body); i++ {
+		if body[i] == gdl90EscByte {
+			i++
+			if i >= len(body) {
+				t.Fatalf("frame ends mid escape sequence: % x", frame)
+			}
+			message = append(message, body[i]^0x20)
+			continue
+		}
+		message = append(message, body[i])
+	}
+
+	return message
+}
@@ -1,7 +1,8 @@
 package main
 
 import (
-	"encoding/binary"
+	"bufio"
+	"flag"
 	"fmt"
 	"io"
 	"log"
@@ -10,65 +11,58 @@ import (
 	"net/url"
 	"os"
 	"strconv"
+	"strings"
 	"time"
-)
-
-const (
-	DM_EPOCH = 1356998400 // Digital Matter epoch: 2013-01-01 00:00:00 UTC
-
-	MSG_HELLO          = 0x00
-	MSG_DATA_RECORDS   = 0x04
-	MSG_COMMIT_REQUEST = 0x05
-	MSG_VERSION        = 0x14
-	MSG_ASYNC_SESSION  = 0x22
-	MSG_SOCKET_CLOSE   = 0x26
-
-	MSG_HELLO_RESPONSE         = 0x01
-	MSG_COMMIT_RESPONSE        = 0x06
-	MSG_ASYNC_SESSION_COMPLETE = 0x23
 
-	FIELD_GPS       = 0x00
-	FIELD_ANALOG_16 = 0x06
-	FIELD_ANALOG_32 = 0x07
+	"github.com/Saturn745/digitalmatter-traccar/protocol"
+	"github.com/Saturn745/digitalmatter-traccar/protocol/digitalmatter"
+	"github.com/Saturn745/digitalmatter-traccar/protocol/ruptela"
 )
 
 type Config struct {
 	Port           string
 	TraccarURL     string
 	TraccarEnabled bool
-}
-
-type GPSData struct {
-	Timestamp     uint32
-	Latitude      float64
-	Longitude     float64
-	Altitude      int16
-	GroundSpeed   uint16
-	Heading       uint8
-	PDOP          uint8
-	PosAccuracy   uint8
-	Valid         bool
-}
-
-type AnalogData struct {
-	BatteryV float64
-}
-
-type DataRecord struct {
-	Timestamp uint32
-	GPS       *GPSData
-	Analog    *AnalogData
+	GDL90Enabled   bool
+	GDL90Targets   []string
+	CaptureDir     string
+	MgmtAddr       string
+	MgmtToken      string
+	Storage        StorageConfig
 }
 
 func loadConfig() Config {
 	port := getEnv("PORT", "20200")
 	traccarURL := getEnv("TRACCAR_URL", "http://localhost:5055")
 	traccarEnabled := getEnv("TRACCAR_ENABLED", "true") == "true"
+	gdl90Enabled := getEnv("GDL90_ENABLED", "false") == "true"
+	captureDir := getEnv("CAPTURE_DIR", "")
+	mgmtAddr := getEnv("MGMT_ADDR", ":8080")
+	mgmtToken := getEnv("MGMT_COMMAND_TOKEN", "")
+
+	var gdl90Targets []string
+	if targets := getEnv("GDL90_TARGETS", ""); targets != "" {
+		gdl90Targets = strings.Split(targets, ",")
+	}
+
+	storage := StorageConfig{
+		Path:          getEnv("DATA_LOG_PATH", ""),
+		MaxMB:         getEnvInt("DATA_LOG_MAX_MB", 256),
+		MaxBackups:    getEnvInt("DATA_LOG_MAX_BACKUPS", 5),
+		FlushRecords:  getEnvInt("DATA_LOG_FLUSH_RECORDS", 50),
+		FlushInterval: time.Duration(getEnvInt("DATA_LOG_FLUSH_SECONDS", 5)) * time.Second,
+	}
 
 	return Config{
 		Port:           port,
 		TraccarURL:     traccarURL,
 		TraccarEnabled: traccarEnabled,
+		GDL90Enabled:   gdl90Enabled,
+		GDL90Targets:   gdl90Targets,
+		CaptureDir:     captureDir,
+		MgmtAddr:       mgmtAddr,
+		MgmtToken:      mgmtToken,
+		Storage:        storage,
 	}
 }
 
@@ -79,7 +73,53 @@ func getEnv(key, defaultVal string) string {
 	return defaultVal
 }
 
+func getEnvInt(key string, defaultVal int) int {
+	val := os.Getenv(key)
+	if val == "" {
+		return defaultVal
+	}
+	parsed, err := strconv.Atoi(val)
+	if err != nil {
+		return defaultVal
+	}
+	return parsed
+}
+
 func main() {
+	replayPath := flag.String("replay", "", "replay a CAPTURE_DIR recording instead of listening on a socket")
+	exportDB := flag.String("export", "", "dump a DATA_LOG_PATH database to CSV or GPX instead of listening on a socket")
+	exportIMEI := flag.String("export-imei", "", "IMEI to export (required with -export)")
+	exportFormat := flag.String("export-format", "csv", "export format: csv or gpx")
+	exportFrom := flag.String("export-from", "", "RFC3339 start time (default: epoch)")
+	exportTo := flag.String("export-to", "", "RFC3339 end time (default: now)")
+	exportOut := flag.String("export-out", "", "output file path (default: stdout)")
+	flag.Parse()
+
+	commandQueue := digitalmatter.NewCommandQueue()
+
+	protocols := []protocol.Protocol{
+		digitalmatter.New(commandQueue),
+		ruptela.New(),
+	}
+
+	if *replayPath != "" {
+		if err := runReplay(*replayPath, protocols); err != nil {
+			log.Fatalf("Replay failed: %v", err)
+		}
+		return
+	}
+
+	if *exportDB != "" {
+		opts, err := parseExportOptions(*exportDB, *exportIMEI, *exportFormat, *exportFrom, *exportTo, *exportOut)
+		if err != nil {
+			log.Fatalf("Export failed: %v", err)
+		}
+		if err := runExport(opts); err != nil {
+			log.Fatalf("Export failed: %v", err)
+		}
+		return
+	}
+
 	config := loadConfig()
 
 	listener, err := net.Listen("tcp", ":"+config.Port)
@@ -88,279 +128,222 @@ func main() {
 	}
 	defer listener.Close()
 
-	log.Printf("Digital Matter Server listening on port %s", config.Port)
+	log.Printf("Tracker server listening on port %s", config.Port)
 	if config.TraccarEnabled {
 		log.Printf("Traccar forwarding enabled: %s", config.TraccarURL)
 	}
+	if config.CaptureDir != "" {
+		log.Printf("Capturing raw streams to %s", config.CaptureDir)
+	}
 
-	for {
-		conn, err := listener.Accept()
+	if config.MgmtToken == "" {
+		log.Printf("WARNING: MGMT_COMMAND_TOKEN is not set; POST /devices/{imei}/command is disabled until it is")
+	}
+
+	registry := newRegistry()
+	startManagementServer(config.MgmtAddr, registry, commandQueue, config.MgmtToken)
+
+	var storage *Storage
+	if config.Storage.Path != "" {
+		var err error
+		storage, err = newStorage(config.Storage)
 		if err != nil {
-			log.Printf("Accept error: %v", err)
-			continue
+			log.Fatalf("Failed to open data log %s: %v", config.Storage.Path, err)
 		}
-
-		go handleConnection(conn, config)
+		defer storage.Close()
+		log.Printf("Logging parsed records to %s", config.Storage.Path)
 	}
-}
-
-func handleConnection(conn net.Conn, config Config) {
-	defer conn.Close()
 
-	buf := make([]byte, 4096)
-	pendingData := []byte{}
-	var deviceIMEI string
+	sink := buildSink(config, registry, storage)
 
 	for {
-		conn.SetReadDeadline(time.Now().Add(10 * time.Minute))
-
-		n, err := conn.Read(buf)
+		conn, err := listener.Accept()
 		if err != nil {
-			if err != io.EOF && !isTimeout(err) {
-				log.Printf("Read error from %s: %v", conn.RemoteAddr(), err)
-			}
-			break
-		}
-
-		if n == 0 {
+			log.Printf("Accept error: %v", err)
 			continue
 		}
 
-		data := append(pendingData, buf[:n]...)
-		pendingData = []byte{}
-
-		processedBytes, responses := processMessages(data, &deviceIMEI, config)
-
-		if processedBytes < len(data) {
-			pendingData = data[processedBytes:]
-		}
-
-		for _, response := range responses {
-			if response != nil {
-				if _, err := conn.Write(response); err != nil {
-					log.Printf("Write error to %s: %v", conn.RemoteAddr(), err)
-					return
-				}
-			}
-		}
+		go dispatch(conn, protocols, sink, registry, config.CaptureDir)
 	}
 }
 
-func processMessages(data []byte, deviceIMEI *string, config Config) (int, [][]byte) {
-	responses := [][]byte{}
-	offset := 0
+// dispatchDetectTimeout bounds how long dispatch will wait for a connection
+// to send enough bytes to identify its protocol, so a client that opens a
+// connection and never sends anything can't block the dispatch goroutine
+// forever.
+const dispatchDetectTimeout = 10 * time.Second
 
-	for offset < len(data)-2 {
-		if data[offset] != 0x02 || offset+1 >= len(data) || data[offset+1] != 0x55 {
-			offset++
-			continue
-		}
+// dispatch peeks at the first bytes a connection sends and hands it off to
+// whichever registered Protocol recognizes them, so a single port can serve
+// several tracker wire formats.
+func dispatch(conn net.Conn, protocols []protocol.Protocol, sink protocol.PositionSink, registry *Registry, captureDir string) {
+	registry.ConnectionOpened()
+	defer registry.ConnectionClosed()
 
-		if offset+5 > len(data) {
-			break
-		}
+	reader := bufio.NewReaderSize(conn, 16)
 
-		msgType := data[offset+2]
-		payloadLen := binary.LittleEndian.Uint16(data[offset+3 : offset+5])
-		totalLen := 5 + int(payloadLen)
+	conn.SetReadDeadline(time.Now().Add(dispatchDetectTimeout))
 
-		if offset+totalLen > len(data) {
-			break
-		}
+	peek, err := reader.Peek(10)
+	if err != nil && len(peek) == 0 {
+		log.Printf("Dispatch: failed to read initial bytes from %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
 
-		message := data[offset : offset+totalLen]
+	// A protocol's own Handle manages read deadlines for the lifetime of the
+	// connection; clear the detection deadline before handing off so it
+	// doesn't race with that.
+	conn.SetReadDeadline(time.Time{})
 
-		imei := parseIMEI(message, msgType)
-		if imei != "" {
-			if *deviceIMEI == "" {
-				*deviceIMEI = imei
-				log.Printf("Connection from IMEI: %s", imei)
-			}
-		}
+	var traffic net.Conn = &bufferedConn{Reader: reader, Conn: conn}
+	traffic = &byteCountingConn{Conn: traffic, registry: registry}
 
-		if msgType == MSG_DATA_RECORDS {
-			records := parseDataRecords(message)
-			for _, record := range records {
-				if record.GPS != nil && record.GPS.Valid {
-					log.Printf("Got GPS data from IMEI %s: %.6f, %.6f", *deviceIMEI, record.GPS.Latitude, record.GPS.Longitude)
-
-					if config.TraccarEnabled && *deviceIMEI != "" {
-						battery := 0.0
-						if record.Analog != nil {
-							battery = record.Analog.BatteryV
-						}
-
-						if err := forwardToTraccar(config.TraccarURL, *deviceIMEI, record.GPS, record.Timestamp, battery); err != nil {
-							log.Printf("Traccar forward error for IMEI %s: %v", *deviceIMEI, err)
-						}
-					}
-				}
-			}
-		}
+	if captureDir != "" {
+		writer := newCaptureWriter(captureDir, conn.RemoteAddr().String())
+		defer writer.Close()
+		traffic = &recordingConn{Conn: traffic, writer: writer}
+		sink = &captureSink{inner: sink, writer: writer}
+	}
 
-		response := buildResponse(msgType)
-		if response != nil {
-			responses = append(responses, response)
-		}
+	sink = &registrySink{inner: sink, registry: registry}
+	sink = &sourceIPSink{inner: sink, addr: conn.RemoteAddr().String()}
 
-		offset += totalLen
+	for _, p := range protocols {
+		if p.Detect(peek) {
+			p.Handle(traffic, sink, registry)
+			return
+		}
 	}
 
-	return offset, responses
+	log.Printf("Dispatch: no protocol matched initial bytes from %s, closing", conn.RemoteAddr())
+	conn.Close()
 }
 
-func parseIMEI(data []byte, msgType uint8) string {
-	if msgType != MSG_HELLO || len(data) < 9 {
-		return ""
-	}
+// byteCountingConn tallies bytes read from and written to a connection into
+// the registry's server-wide counters.
+type byteCountingConn struct {
+	net.Conn
+	registry *Registry
+}
 
-	if len(data) > 9 {
-		imeiEnd := 9
-		for imeiEnd < len(data) && data[imeiEnd] != 0x00 {
-			imeiEnd++
-		}
-		if imeiEnd > 9 {
-			return string(data[9:imeiEnd])
-		}
+func (c *byteCountingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.registry.AddBytesIn(n)
 	}
-	return ""
+	return n, err
 }
 
-func parseDataRecords(data []byte) []DataRecord {
-	records := []DataRecord{}
-
-	if len(data) < 5 {
-		return records
+func (c *byteCountingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.registry.AddBytesOut(n)
 	}
+	return n, err
+}
 
-	payload := data[5:]
-	offset := 0
-
-	for offset < len(payload) {
-		if offset+11 > len(payload) {
-			break
-		}
-
-		recordLen := binary.LittleEndian.Uint16(payload[offset : offset+2])
-		if recordLen < 11 || offset+int(recordLen) > len(payload) {
-			break
-		}
-
-		record := DataRecord{
-			Timestamp: binary.LittleEndian.Uint32(payload[offset+6 : offset+10]),
-		}
+// sourceIPSink stamps a position with the remote address of the connection
+// it was parsed from, for sinks that archive where a fix came from.
+type sourceIPSink struct {
+	inner protocol.PositionSink
+	addr  string
+}
 
-		fieldOffset := offset + 11
-		for fieldOffset < offset+int(recordLen) {
-			if fieldOffset+2 > len(payload) {
-				break
-			}
+func (s *sourceIPSink) Forward(pos protocol.Position) error {
+	pos.SourceIP = s.addr
+	return s.inner.Forward(pos)
+}
 
-			fieldID := payload[fieldOffset]
-			fieldLen := payload[fieldOffset+1]
+// bufferedConn lets a Protocol keep reading through the bufio.Reader used to
+// peek the connection's initial bytes, while writes still go straight to the
+// underlying conn.
+type bufferedConn struct {
+	*bufio.Reader
+	net.Conn
+}
 
-			if fieldOffset+2+int(fieldLen) > len(payload) {
-				break
-			}
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	return b.Reader.Read(p)
+}
 
-			fieldData := payload[fieldOffset+2 : fieldOffset+2+int(fieldLen)]
+// multiSink fans a decoded position out to every configured output.
+type multiSink struct {
+	sinks []protocol.PositionSink
+}
 
-			switch fieldID {
-			case FIELD_GPS:
-				record.GPS = parseGPSField(fieldData)
-			case FIELD_ANALOG_16:
-				record.Analog = parseAnalog16Field(fieldData)
-			case FIELD_ANALOG_32:
-				record.Analog = parseAnalog32Field(fieldData)
+func (m *multiSink) Forward(pos protocol.Position) error {
+	var firstErr error
+	for _, s := range m.sinks {
+		if err := s.Forward(pos); err != nil {
+			if firstErr == nil {
+				firstErr = err
 			}
-
-			fieldOffset += 2 + int(fieldLen)
 		}
-
-		records = append(records, record)
-		offset += int(recordLen)
 	}
-
-	return records
+	return firstErr
 }
 
-func parseGPSField(data []byte) *GPSData {
-	if len(data) < 21 {
-		return nil
-	}
+func buildSink(config Config, registry *Registry, storage *Storage) protocol.PositionSink {
+	var sinks []protocol.PositionSink
 
-	return &GPSData{
-		Timestamp:   binary.LittleEndian.Uint32(data[0:4]),
-		Latitude:    float64(int32(binary.LittleEndian.Uint32(data[4:8]))) / 10000000.0,
-		Longitude:   float64(int32(binary.LittleEndian.Uint32(data[8:12]))) / 10000000.0,
-		Altitude:    int16(binary.LittleEndian.Uint16(data[12:14])),
-		GroundSpeed: binary.LittleEndian.Uint16(data[14:16]),
-		Heading:     data[17],
-		PDOP:        data[18],
-		PosAccuracy: data[19],
-		Valid:       true,
+	if config.TraccarEnabled {
+		sinks = append(sinks, &traccarSink{url: config.TraccarURL, registry: registry})
 	}
-}
 
-func parseAnalog16Field(data []byte) *AnalogData {
-	analog := &AnalogData{}
+	if gdl90 := startGDL90Sender(config); gdl90 != nil {
+		sinks = append(sinks, gdl90)
+	}
 
-	for i := 0; i < len(data); {
-		if i+2 >= len(data) {
-			break
-		}
+	if storage != nil {
+		sinks = append(sinks, &storageSink{storage: storage})
+	}
 
-		analogID := data[i]
-		value := int16(binary.LittleEndian.Uint16(data[i+1 : i+3]))
+	return &multiSink{sinks: sinks}
+}
 
-		if analogID == 1 {
-			analog.BatteryV = float64(value) / 1000.0
-		}
+type traccarSink struct {
+	url      string
+	registry *Registry
+}
 
-		i += 3
+func (t *traccarSink) Forward(pos protocol.Position) error {
+	if pos.IMEI == "" {
+		return nil
 	}
 
-	return analog
-}
-
-func parseAnalog32Field(data []byte) *AnalogData {
-	return &AnalogData{}
+	err := forwardToTraccar(t.url, pos)
+	t.registry.RecordForward(err == nil)
+	return err
 }
 
-func forwardToTraccar(traccarURL, imei string, gps *GPSData, timestamp uint32, battery float64) error {
+func forwardToTraccar(traccarURL string, pos protocol.Position) error {
 	params := url.Values{}
-	params.Set("id", imei)
-	params.Set("lat", fmt.Sprintf("%.6f", gps.Latitude))
-	params.Set("lon", fmt.Sprintf("%.6f", gps.Longitude))
+	params.Set("id", pos.IMEI)
+	params.Set("lat", fmt.Sprintf("%.6f", pos.Latitude))
+	params.Set("lon", fmt.Sprintf("%.6f", pos.Longitude))
+	params.Set("timestamp", strconv.FormatInt(pos.Time.Unix(), 10))
 
-	unixTimestamp := int64(timestamp) + DM_EPOCH
-	params.Set("timestamp", strconv.FormatInt(unixTimestamp, 10))
-
-	if gps.Altitude != 0 {
-		params.Set("altitude", strconv.Itoa(int(gps.Altitude)))
+	if pos.Altitude != 0 {
+		params.Set("altitude", strconv.Itoa(int(pos.Altitude)))
 	}
 
-	if gps.GroundSpeed > 0 {
-		speedKnots := float64(gps.GroundSpeed) * 0.539957
-		params.Set("speed", fmt.Sprintf("%.2f", speedKnots))
+	if pos.GroundSpeed > 0 {
+		params.Set("speed", fmt.Sprintf("%.2f", pos.GroundSpeed))
 	}
 
-	bearing := float64(gps.Heading) * 5.625
-	if bearing > 360 {
-		bearing -= 360
-	}
-	params.Set("bearing", fmt.Sprintf("%.1f", bearing))
+	params.Set("bearing", fmt.Sprintf("%.1f", pos.Heading))
 
-	if gps.PosAccuracy > 0 {
-		params.Set("accuracy", strconv.Itoa(int(gps.PosAccuracy)))
+	if pos.Accuracy > 0 {
+		params.Set("accuracy", strconv.Itoa(int(pos.Accuracy)))
 	}
 
-	if gps.PDOP > 0 {
-		params.Set("hdop", fmt.Sprintf("%.1f", float64(gps.PDOP)/10.0))
+	if pos.PDOP > 0 {
+		params.Set("hdop", fmt.Sprintf("%.1f", pos.PDOP))
 	}
 
-	if battery > 0 {
-		batteryPercent := ((battery - 3.0) / (4.5 - 3.0)) * 100.0
+	if pos.BatteryV > 0 {
+		batteryPercent := ((pos.BatteryV - 3.0) / (4.5 - 3.0)) * 100.0
 		if batteryPercent < 0 {
 			batteryPercent = 0
 		}
@@ -388,56 +371,3 @@ func forwardToTraccar(traccarURL, imei string, gps *GPSData, timestamp uint32, b
 
 	return nil
 }
-
-func buildResponse(msgType uint8) []byte {
-	switch msgType {
-	case MSG_HELLO:
-		return buildHelloResponse()
-	case MSG_COMMIT_REQUEST:
-		return buildCommitResponse()
-	case MSG_ASYNC_SESSION:
-		return buildAsyncSessionCompleteResponse()
-	default:
-		return nil
-	}
-}
-
-func buildHelloResponse() []byte {
-	now := time.Now().Unix()
-	dmTime := uint32(now - DM_EPOCH)
-
-	response := make([]byte, 13)
-	response[0] = 0x02
-	response[1] = 0x55
-	response[2] = MSG_HELLO_RESPONSE
-	binary.LittleEndian.PutUint16(response[3:5], 0x0008)
-	binary.LittleEndian.PutUint32(response[5:9], dmTime)
-
-	return response
-}
-
-func buildCommitResponse() []byte {
-	response := make([]byte, 6)
-	response[0] = 0x02
-	response[1] = 0x55
-	response[2] = MSG_COMMIT_RESPONSE
-	binary.LittleEndian.PutUint16(response[3:5], 0x0001)
-	response[5] = 0x01
-
-	return response
-}
-
-func buildAsyncSessionCompleteResponse() []byte {
-	response := make([]byte, 5)
-	response[0] = 0x02
-	response[1] = 0x55
-	response[2] = MSG_ASYNC_SESSION_COMPLETE
-	binary.LittleEndian.PutUint16(response[3:5], 0x0000)
-
-	return response
-}
-
-func isTimeout(err error) bool {
-	netErr, ok := err.(net.Error)
-	return ok && netErr.Timeout()
-}
\ No newline at end of file
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Saturn745/digitalmatter-traccar/protocol"
+	"github.com/Saturn745/digitalmatter-traccar/protocol/digitalmatter"
+)
+
+// startManagementServer starts the JSON management API on addr. It never
+// blocks the caller; a failure to bind is logged and the server is simply
+// not available.
+//
+// commandToken gates POST /devices/{imei}/command: requests must carry it as
+// "Authorization: Bearer <token>". The rest of the API is read-only and
+// unauthenticated. If commandToken is empty the command endpoint is disabled
+// outright, since MGMT_ADDR defaults to all interfaces and an unauthenticated
+// write endpoint there can reboot or reconfigure every connected tracker.
+func startManagementServer(addr string, registry *Registry, commands *digitalmatter.CommandQueue, commandToken string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/status", handleStatus(registry))
+	mux.HandleFunc("/devices", handleDevices(registry))
+	mux.HandleFunc("/devices/", handleDeviceSubresource(registry, commands, commandToken))
+
+	go func() {
+		log.Printf("Management API listening on %s", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("Management API stopped: %v", err)
+		}
+	}()
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("mgmt: failed to encode response: %v", err)
+	}
+}
+
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]string{"status": "ok"})
+}
+
+func handleStatus(registry *Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, registry.Status())
+	}
+}
+
+func handleDevices(registry *Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, registry.Devices())
+	}
+}
+
+// handleDeviceSubresource serves every /devices/{imei}/... route, dispatching
+// on the trailing path segment and HTTP method since they share one mux
+// pattern.
+func handleDeviceSubresource(registry *Registry, commands *digitalmatter.CommandQueue, commandToken string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, "/devices/")
+		imei, rest, found := strings.Cut(path, "/")
+		if !found || imei == "" {
+			http.NotFound(w, r)
+			return
+		}
+
+		switch {
+		case rest == "history" && r.Method == http.MethodGet:
+			handleDeviceHistory(registry, imei, w, r)
+		case rest == "command" && r.Method == http.MethodPost:
+			if !authorizedForCommand(commandToken, r) {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			handleDeviceCommand(commands, imei, w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	}
+}
+
+// authorizedForCommand reports whether r carries the configured command
+// token as a bearer credential. It always rejects when no token is
+// configured, so the command endpoint fails closed rather than open.
+func authorizedForCommand(commandToken string, r *http.Request) bool {
+	if commandToken == "" {
+		return false
+	}
+
+	const prefix = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, prefix) {
+		return false
+	}
+
+	given := strings.TrimPrefix(auth, prefix)
+	return subtle.ConstantTimeCompare([]byte(given), []byte(commandToken)) == 1
+}
+
+// handleDeviceHistory serves GET /devices/{imei}/history?n=100.
+func handleDeviceHistory(registry *Registry, imei string, w http.ResponseWriter, r *http.Request) {
+	n := 100
+	if raw := r.URL.Query().Get("n"); raw != "" {
+		if parsed, err := strconv.Atoi(raw); err == nil && parsed > 0 {
+			n = parsed
+		}
+	}
+
+	history, ok := registry.History(imei, n)
+	if !ok {
+		http.Error(w, "unknown device", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, struct {
+		IMEI     string              `json:"imei"`
+		Count    int                 `json:"count"`
+		Position []protocol.Position `json:"history"`
+	}{IMEI: imei, Count: len(history), Position: history})
+}
+
+// commandRequest is the POST /devices/{imei}/command body.
+type commandRequest struct {
+	Kind        string `json:"kind"`
+	ConfigKey   string `json:"configKey,omitempty"`
+	ConfigValue string `json:"configValue,omitempty"`
+}
+
+// handleDeviceCommand queues a downlink command for imei, to be sent the
+// next time its connection reaches a MSG_ASYNC_SESSION or MSG_COMMIT_REQUEST
+// boundary.
+func handleDeviceCommand(commands *digitalmatter.CommandQueue, imei string, w http.ResponseWriter, r *http.Request) {
+	if commands == nil {
+		http.Error(w, "command queue not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	var req commandRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	var kind digitalmatter.CommandKind
+	switch req.Kind {
+	case string(digitalmatter.CommandReboot):
+		kind = digitalmatter.CommandReboot
+	case string(digitalmatter.CommandPollNow):
+		kind = digitalmatter.CommandPollNow
+	case string(digitalmatter.CommandSetConfig):
+		if req.ConfigKey == "" {
+			http.Error(w, "set_config requires configKey", http.StatusBadRequest)
+			return
+		}
+		kind = digitalmatter.CommandSetConfig
+	default:
+		http.Error(w, fmt.Sprintf("unknown command kind %q", req.Kind), http.StatusBadRequest)
+		return
+	}
+
+	commands.Enqueue(imei, digitalmatter.Command{
+		Kind:        kind,
+		ConfigKey:   req.ConfigKey,
+		ConfigValue: req.ConfigValue,
+	})
+
+	writeJSON(w, map[string]string{"status": "queued"})
+}
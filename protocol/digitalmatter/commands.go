@@ -0,0 +1,92 @@
+package digitalmatter
+
+import (
+	"encoding/binary"
+	"sync"
+)
+
+// CommandKind identifies one of the small set of server-to-device messages
+// the management API can queue.
+type CommandKind string
+
+const (
+	CommandReboot    CommandKind = "reboot"
+	CommandPollNow   CommandKind = "poll_now"
+	CommandSetConfig CommandKind = "set_config"
+)
+
+const (
+	commandTypeReboot    = 0x01
+	commandTypePollNow   = 0x02
+	commandTypeSetConfig = 0x03
+)
+
+// Command is a single queued downlink, identified by Kind. ConfigKey and
+// ConfigValue are only meaningful for CommandSetConfig.
+type Command struct {
+	Kind        CommandKind
+	ConfigKey   string
+	ConfigValue string
+}
+
+// CommandQueue holds outbound commands queued per IMEI until the wire
+// protocol reaches a point where the server is permitted to write, at which
+// point processMessages drains them with Drain.
+type CommandQueue struct {
+	mu     sync.Mutex
+	byIMEI map[string][]Command
+}
+
+// NewCommandQueue returns an empty CommandQueue.
+func NewCommandQueue() *CommandQueue {
+	return &CommandQueue{byIMEI: make(map[string][]Command)}
+}
+
+// Enqueue appends cmd to imei's pending commands.
+func (q *CommandQueue) Enqueue(imei string, cmd Command) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.byIMEI[imei] = append(q.byIMEI[imei], cmd)
+}
+
+// Drain removes and returns all commands queued for imei.
+func (q *CommandQueue) Drain(imei string) []Command {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	cmds := q.byIMEI[imei]
+	delete(q.byIMEI, imei)
+	return cmds
+}
+
+// buildCommandFrame encodes cmd as a MSG_COMMAND frame, or nil if cmd.Kind
+// is not recognized.
+func buildCommandFrame(cmd Command) []byte {
+	var payload []byte
+
+	switch cmd.Kind {
+	case CommandReboot:
+		payload = []byte{commandTypeReboot}
+	case CommandPollNow:
+		payload = []byte{commandTypePollNow}
+	case CommandSetConfig:
+		key := []byte(cmd.ConfigKey)
+		value := []byte(cmd.ConfigValue)
+		payload = make([]byte, 0, 3+len(key)+len(value))
+		payload = append(payload, commandTypeSetConfig, byte(len(key)))
+		payload = append(payload, key...)
+		payload = append(payload, byte(len(value)))
+		payload = append(payload, value...)
+	default:
+		return nil
+	}
+
+	frame := make([]byte, 5+len(payload))
+	frame[0] = 0x02
+	frame[1] = 0x55
+	frame[2] = msgCommand
+	binary.LittleEndian.PutUint16(frame[3:5], uint16(len(payload)))
+	copy(frame[5:], payload)
+
+	return frame
+}
@@ -0,0 +1,474 @@
+// Package digitalmatter implements the Digital Matter tracker wire protocol:
+// a 0x02 0x55 framed message stream carrying hello/data-record/commit
+// exchanges.
+package digitalmatter
+
+import (
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"github.com/Saturn745/digitalmatter-traccar/protocol"
+)
+
+const (
+	dmEpoch = 1356998400 // Digital Matter epoch: 2013-01-01 00:00:00 UTC
+
+	msgHello         = 0x00
+	msgDataRecords   = 0x04
+	msgCommitRequest = 0x05
+	msgVersion       = 0x14
+	msgAsyncSession  = 0x22
+	msgSocketClose   = 0x26
+	msgCommandAck    = 0x27
+
+	msgHelloResponse        = 0x01
+	msgCommitResponse       = 0x06
+	msgAsyncSessionComplete = 0x23
+	msgCommand              = 0x24
+
+	fieldGPS      = 0x00
+	fieldAnalog16 = 0x06
+	fieldAnalog32 = 0x07
+)
+
+// msgTypeName maps a message type byte to the short label metrics are
+// recorded under.
+func msgTypeName(msgType uint8) string {
+	switch msgType {
+	case msgHello:
+		return "hello"
+	case msgDataRecords:
+		return "data_records"
+	case msgCommitRequest:
+		return "commit_request"
+	case msgVersion:
+		return "version"
+	case msgAsyncSession:
+		return "async_session"
+	case msgSocketClose:
+		return "socket_close"
+	case msgCommandAck:
+		return "command_ack"
+	default:
+		return "unknown"
+	}
+}
+
+type gpsData struct {
+	Timestamp   uint32
+	Latitude    float64
+	Longitude   float64
+	Altitude    int16
+	GroundSpeed uint16
+	Heading     uint8
+	PDOP        uint8
+	PosAccuracy uint8
+	Valid       bool
+}
+
+type analogData struct {
+	BatteryV float64
+}
+
+type dataRecord struct {
+	Timestamp uint32
+	GPS       *gpsData
+	Analog    *analogData
+}
+
+// Protocol is the digitalmatter.Protocol implementation.
+type Protocol struct {
+	commands *CommandQueue
+}
+
+// New returns a Digital Matter protocol handler. commands may be nil, in
+// which case no outbound commands are ever drained for this handler.
+func New(commands *CommandQueue) *Protocol {
+	return &Protocol{commands: commands}
+}
+
+func (p *Protocol) Name() string {
+	return "digitalmatter"
+}
+
+// Detect recognizes the 0x02 0x55 Digital Matter preamble.
+func (p *Protocol) Detect(initial []byte) bool {
+	return len(initial) >= 2 && initial[0] == 0x02 && initial[1] == 0x55
+}
+
+func (p *Protocol) Handle(conn net.Conn, sink protocol.PositionSink, metrics protocol.Metrics) {
+	defer conn.Close()
+
+	buf := make([]byte, 4096)
+	pendingData := []byte{}
+	var deviceIMEI string
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(10 * time.Minute))
+
+		n, err := conn.Read(buf)
+		if err != nil {
+			if err != io.EOF && !isTimeout(err) {
+				log.Printf("digitalmatter: read error from %s: %v", conn.RemoteAddr(), err)
+			}
+			break
+		}
+
+		if n == 0 {
+			continue
+		}
+
+		data := append(pendingData, buf[:n]...)
+		pendingData = []byte{}
+
+		processedBytes, responses := processMessages(data, &deviceIMEI, sink, metrics, p.commands)
+
+		if processedBytes < len(data) {
+			pendingData = data[processedBytes:]
+		}
+
+		for _, response := range responses {
+			if response != nil {
+				if _, err := conn.Write(response); err != nil {
+					log.Printf("digitalmatter: write error to %s: %v", conn.RemoteAddr(), err)
+					return
+				}
+			}
+		}
+	}
+}
+
+func processMessages(data []byte, deviceIMEI *string, sink protocol.PositionSink, metrics protocol.Metrics, commands *CommandQueue) (int, [][]byte) {
+	responses := [][]byte{}
+	offset := 0
+
+	for offset < len(data)-2 {
+		if data[offset] != 0x02 || offset+1 >= len(data) || data[offset+1] != 0x55 {
+			offset++
+			continue
+		}
+
+		if offset+5 > len(data) {
+			break
+		}
+
+		msgType := data[offset+2]
+		payloadLen := binary.LittleEndian.Uint16(data[offset+3 : offset+5])
+		totalLen := 5 + int(payloadLen)
+
+		if offset+totalLen > len(data) {
+			break
+		}
+
+		message := data[offset : offset+totalLen]
+
+		metrics.RecordMessage(msgTypeName(msgType))
+
+		imei := parseIMEI(message, msgType)
+		if imei != "" {
+			if *deviceIMEI == "" {
+				*deviceIMEI = imei
+				log.Printf("digitalmatter: connection from IMEI: %s", imei)
+			}
+		}
+
+		if msgType == msgDataRecords {
+			records := parseDataRecords(message)
+			for _, record := range records {
+				if record.GPS != nil && record.GPS.Valid {
+					log.Printf("digitalmatter: got GPS data from IMEI %s: %.6f, %.6f", *deviceIMEI, record.GPS.Latitude, record.GPS.Longitude)
+
+					if *deviceIMEI != "" {
+						if err := sink.Forward(toPosition(*deviceIMEI, record, message)); err != nil {
+							log.Printf("digitalmatter: sink forward error for IMEI %s: %v", *deviceIMEI, err)
+						}
+					}
+				}
+			}
+		}
+
+		if msgType == msgVersion {
+			if hardware, firmware, serial, ok := parseVersion(message); ok && *deviceIMEI != "" {
+				log.Printf("digitalmatter: IMEI %s reports hardware=%s firmware=%s serial=%s", *deviceIMEI, hardware, firmware, serial)
+				metrics.RecordDeviceInfo(protocol.DeviceInfo{
+					IMEI:     *deviceIMEI,
+					Hardware: hardware,
+					Firmware: firmware,
+					Serial:   serial,
+				})
+			}
+		}
+
+		if msgType == msgCommandAck {
+			logCommandAck(*deviceIMEI, message)
+		}
+
+		response := buildResponse(msgType)
+		if response != nil {
+			responses = append(responses, response)
+		}
+
+		// The DM protocol only permits the server to write at these two
+		// points in the exchange, so queued commands are drained here
+		// rather than written as soon as they're enqueued.
+		if commands != nil && *deviceIMEI != "" && (msgType == msgAsyncSession || msgType == msgCommitRequest) {
+			for _, cmd := range commands.Drain(*deviceIMEI) {
+				if frame := buildCommandFrame(cmd); frame != nil {
+					responses = append(responses, frame)
+				}
+			}
+		}
+
+		offset += totalLen
+	}
+
+	return offset, responses
+}
+
+// parseVersion decodes a MSG_VERSION payload into its hardware, firmware and
+// serial fields, each encoded as a length-prefixed string.
+func parseVersion(message []byte) (hardware, firmware, serial string, ok bool) {
+	if len(message) < 5 {
+		return "", "", "", false
+	}
+
+	payload := message[5:]
+	offset := 0
+
+	readField := func() (string, bool) {
+		if offset >= len(payload) {
+			return "", false
+		}
+		length := int(payload[offset])
+		offset++
+		if offset+length > len(payload) {
+			return "", false
+		}
+		value := string(payload[offset : offset+length])
+		offset += length
+		return value, true
+	}
+
+	var okHW, okFW, okSerial bool
+	hardware, okHW = readField()
+	firmware, okFW = readField()
+	serial, okSerial = readField()
+	return hardware, firmware, serial, okHW && okFW && okSerial
+}
+
+// logCommandAck reports whether a device accepted or rejected the last
+// command sent to it.
+func logCommandAck(imei string, message []byte) {
+	if len(message) < 6 {
+		return
+	}
+	if message[5] == 0x00 {
+		log.Printf("digitalmatter: IMEI %s acked command", imei)
+	} else {
+		log.Printf("digitalmatter: IMEI %s nacked command (status=0x%02x)", imei, message[5])
+	}
+}
+
+// toPosition converts a Digital Matter data record into the normalized
+// Position shape shared by every sink.
+func toPosition(imei string, record dataRecord, rawMessage []byte) protocol.Position {
+	gps := record.GPS
+
+	battery := 0.0
+	if record.Analog != nil {
+		battery = record.Analog.BatteryV
+	}
+
+	bearing := float64(gps.Heading) * 5.625
+	if bearing > 360 {
+		bearing -= 360
+	}
+
+	return protocol.Position{
+		IMEI:        imei,
+		Time:        time.Unix(int64(record.Timestamp)+dmEpoch, 0),
+		Latitude:    gps.Latitude,
+		Longitude:   gps.Longitude,
+		Altitude:    float64(gps.Altitude),
+		GroundSpeed: float64(gps.GroundSpeed) * 0.539957,
+		Heading:     bearing,
+		PDOP:        float64(gps.PDOP) / 10.0,
+		Accuracy:    float64(gps.PosAccuracy),
+		BatteryV:    battery,
+		RawFrame:    append([]byte{}, rawMessage...),
+	}
+}
+
+func parseIMEI(data []byte, msgType uint8) string {
+	if msgType != msgHello || len(data) < 9 {
+		return ""
+	}
+
+	if len(data) > 9 {
+		imeiEnd := 9
+		for imeiEnd < len(data) && data[imeiEnd] != 0x00 {
+			imeiEnd++
+		}
+		if imeiEnd > 9 {
+			return string(data[9:imeiEnd])
+		}
+	}
+	return ""
+}
+
+func parseDataRecords(data []byte) []dataRecord {
+	records := []dataRecord{}
+
+	if len(data) < 5 {
+		return records
+	}
+
+	payload := data[5:]
+	offset := 0
+
+	for offset < len(payload) {
+		if offset+11 > len(payload) {
+			break
+		}
+
+		recordLen := binary.LittleEndian.Uint16(payload[offset : offset+2])
+		if recordLen < 11 || offset+int(recordLen) > len(payload) {
+			break
+		}
+
+		record := dataRecord{
+			Timestamp: binary.LittleEndian.Uint32(payload[offset+6 : offset+10]),
+		}
+
+		fieldOffset := offset + 11
+		for fieldOffset < offset+int(recordLen) {
+			if fieldOffset+2 > len(payload) {
+				break
+			}
+
+			fieldID := payload[fieldOffset]
+			fieldLen := payload[fieldOffset+1]
+
+			if fieldOffset+2+int(fieldLen) > len(payload) {
+				break
+			}
+
+			fieldData := payload[fieldOffset+2 : fieldOffset+2+int(fieldLen)]
+
+			switch fieldID {
+			case fieldGPS:
+				record.GPS = parseGPSField(fieldData)
+			case fieldAnalog16:
+				record.Analog = parseAnalog16Field(fieldData)
+			case fieldAnalog32:
+				record.Analog = parseAnalog32Field(fieldData)
+			}
+
+			fieldOffset += 2 + int(fieldLen)
+		}
+
+		records = append(records, record)
+		offset += int(recordLen)
+	}
+
+	return records
+}
+
+func parseGPSField(data []byte) *gpsData {
+	if len(data) < 21 {
+		return nil
+	}
+
+	return &gpsData{
+		Timestamp:   binary.LittleEndian.Uint32(data[0:4]),
+		Latitude:    float64(int32(binary.LittleEndian.Uint32(data[4:8]))) / 10000000.0,
+		Longitude:   float64(int32(binary.LittleEndian.Uint32(data[8:12]))) / 10000000.0,
+		Altitude:    int16(binary.LittleEndian.Uint16(data[12:14])),
+		GroundSpeed: binary.LittleEndian.Uint16(data[14:16]),
+		Heading:     data[17],
+		PDOP:        data[18],
+		PosAccuracy: data[19],
+		Valid:       true,
+	}
+}
+
+func parseAnalog16Field(data []byte) *analogData {
+	analog := &analogData{}
+
+	for i := 0; i < len(data); {
+		if i+2 >= len(data) {
+			break
+		}
+
+		analogID := data[i]
+		value := int16(binary.LittleEndian.Uint16(data[i+1 : i+3]))
+
+		if analogID == 1 {
+			analog.BatteryV = float64(value) / 1000.0
+		}
+
+		i += 3
+	}
+
+	return analog
+}
+
+func parseAnalog32Field(data []byte) *analogData {
+	return &analogData{}
+}
+
+func buildResponse(msgType uint8) []byte {
+	switch msgType {
+	case msgHello:
+		return buildHelloResponse()
+	case msgCommitRequest:
+		return buildCommitResponse()
+	case msgAsyncSession:
+		return buildAsyncSessionCompleteResponse()
+	default:
+		return nil
+	}
+}
+
+func buildHelloResponse() []byte {
+	now := time.Now().Unix()
+	dmTime := uint32(now - dmEpoch)
+
+	response := make([]byte, 13)
+	response[0] = 0x02
+	response[1] = 0x55
+	response[2] = msgHelloResponse
+	binary.LittleEndian.PutUint16(response[3:5], 0x0008)
+	binary.LittleEndian.PutUint32(response[5:9], dmTime)
+
+	return response
+}
+
+func buildCommitResponse() []byte {
+	response := make([]byte, 6)
+	response[0] = 0x02
+	response[1] = 0x55
+	response[2] = msgCommitResponse
+	binary.LittleEndian.PutUint16(response[3:5], 0x0001)
+	response[5] = 0x01
+
+	return response
+}
+
+func buildAsyncSessionCompleteResponse() []byte {
+	response := make([]byte, 5)
+	response[0] = 0x02
+	response[1] = 0x55
+	response[2] = msgAsyncSessionComplete
+	binary.LittleEndian.PutUint16(response[3:5], 0x0000)
+
+	return response
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
@@ -0,0 +1,187 @@
+package digitalmatter
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/Saturn745/digitalmatter-traccar/protocol"
+)
+
+// buildMessage assembles a 0x02 0x55 framed message from a type byte and
+// payload, the way every Digital Matter message on the wire is shaped.
+func buildMessage(msgType uint8, payload []byte) []byte {
+	message := make([]byte, 5+len(payload))
+	message[0] = 0x02
+	message[1] = 0x55
+	message[2] = msgType
+	binary.LittleEndian.PutUint16(message[3:5], uint16(len(payload)))
+	copy(message[5:], payload)
+	return message
+}
+
+func TestParseIMEI(t *testing.T) {
+	payload := make([]byte, 4+16) // 4 reserved bytes + IMEI + NUL terminator
+	copy(payload[4:], "123456789012345\x00")
+	message := buildMessage(msgHello, payload)
+
+	if got := parseIMEI(message, msgHello); got != "123456789012345" {
+		t.Errorf("parseIMEI = %q, want %q", got, "123456789012345")
+	}
+
+	if got := parseIMEI(message, msgDataRecords); got != "" {
+		t.Errorf("parseIMEI for non-hello message = %q, want empty", got)
+	}
+}
+
+func TestParseDataRecords(t *testing.T) {
+	gps := make([]byte, 21)
+	binary.LittleEndian.PutUint32(gps[0:4], 1000)
+	binary.LittleEndian.PutUint32(gps[4:8], uint32(int32(525200000)))  // 52.52 deg
+	binary.LittleEndian.PutUint32(gps[8:12], uint32(int32(134050000))) // 13.405 deg
+	binary.LittleEndian.PutUint16(gps[12:14], uint16(int16(100)))      // altitude
+	binary.LittleEndian.PutUint16(gps[14:16], 20)                      // ground speed
+	gps[17] = 10                                                       // heading unit (*5.625 deg)
+	gps[18] = 25                                                       // PDOP (/10)
+	gps[19] = 5                                                        // accuracy
+
+	record := make([]byte, 11+2+len(gps))
+	binary.LittleEndian.PutUint16(record[0:2], uint16(len(record)))
+	binary.LittleEndian.PutUint32(record[6:10], 555) // record timestamp
+	record[11] = fieldGPS
+	record[12] = byte(len(gps))
+	copy(record[13:], gps)
+
+	message := buildMessage(msgDataRecords, record)
+
+	records := parseDataRecords(message)
+	if len(records) != 1 {
+		t.Fatalf("got %d records, want 1", len(records))
+	}
+
+	r := records[0]
+	if r.Timestamp != 555 {
+		t.Errorf("Timestamp = %d, want 555", r.Timestamp)
+	}
+	if r.GPS == nil || !r.GPS.Valid {
+		t.Fatalf("GPS field not parsed: %+v", r)
+	}
+	if r.GPS.Latitude != 52.52 {
+		t.Errorf("Latitude = %v, want 52.52", r.GPS.Latitude)
+	}
+	if r.GPS.Longitude != 13.405 {
+		t.Errorf("Longitude = %v, want 13.405", r.GPS.Longitude)
+	}
+	if r.GPS.Altitude != 100 {
+		t.Errorf("Altitude = %v, want 100", r.GPS.Altitude)
+	}
+
+	pos := toPosition("123456789012345", r, message)
+	if pos.Heading != 56.25 {
+		t.Errorf("Heading = %v, want 56.25", pos.Heading)
+	}
+	if pos.PDOP != 2.5 {
+		t.Errorf("PDOP = %v, want 2.5", pos.PDOP)
+	}
+}
+
+func TestParseVersion(t *testing.T) {
+	payload := []byte{}
+	for _, field := range []string{"G62", "1.4.2", "SN-0042"} {
+		payload = append(payload, byte(len(field)))
+		payload = append(payload, []byte(field)...)
+	}
+	message := buildMessage(msgVersion, payload)
+
+	hardware, firmware, serial, ok := parseVersion(message)
+	if !ok {
+		t.Fatalf("parseVersion failed on well-formed payload")
+	}
+	if hardware != "G62" || firmware != "1.4.2" || serial != "SN-0042" {
+		t.Errorf("parseVersion = (%q, %q, %q), want (G62, 1.4.2, SN-0042)", hardware, firmware, serial)
+	}
+}
+
+func TestParseVersionTruncated(t *testing.T) {
+	message := buildMessage(msgVersion, []byte{0x05, 'a', 'b'}) // claims 5 bytes, only 2 follow
+	if _, _, _, ok := parseVersion(message); ok {
+		t.Fatal("expected parseVersion to fail on a truncated field, got ok")
+	}
+}
+
+// fakeSink and fakeMetrics let processMessages be exercised end to end
+// without a real net.Conn or *Registry.
+type fakeSink struct {
+	forwarded []protocol.Position
+}
+
+func (s *fakeSink) Forward(pos protocol.Position) error {
+	s.forwarded = append(s.forwarded, pos)
+	return nil
+}
+
+type fakeMetrics struct {
+	messages    []string
+	deviceInfos []protocol.DeviceInfo
+}
+
+func (m *fakeMetrics) RecordMessage(kind string) {
+	m.messages = append(m.messages, kind)
+}
+
+func (m *fakeMetrics) RecordDeviceInfo(info protocol.DeviceInfo) {
+	m.deviceInfos = append(m.deviceInfos, info)
+}
+
+func TestProcessMessagesForwardsGPSAndDeviceInfo(t *testing.T) {
+	helloPayload := make([]byte, 4+16)
+	copy(helloPayload[4:], "123456789012345\x00")
+	hello := buildMessage(msgHello, helloPayload)
+
+	gps := make([]byte, 21)
+	binary.LittleEndian.PutUint32(gps[4:8], uint32(int32(10000000)))
+	binary.LittleEndian.PutUint32(gps[8:12], uint32(int32(20000000)))
+	gps[17], gps[18], gps[19] = 1, 1, 1
+	record := make([]byte, 11+2+len(gps))
+	binary.LittleEndian.PutUint16(record[0:2], uint16(len(record)))
+	record[11] = fieldGPS
+	record[12] = byte(len(gps))
+	copy(record[13:], gps)
+	dataRecords := buildMessage(msgDataRecords, record)
+
+	versionPayload := []byte{}
+	for _, field := range []string{"G62", "1.0", "SN-1"} {
+		versionPayload = append(versionPayload, byte(len(field)))
+		versionPayload = append(versionPayload, []byte(field)...)
+	}
+	version := buildMessage(msgVersion, versionPayload)
+
+	data := append(append(append([]byte{}, hello...), dataRecords...), version...)
+
+	sink := &fakeSink{}
+	metrics := &fakeMetrics{}
+	var imei string
+
+	consumed, responses := processMessages(data, &imei, sink, metrics, nil)
+
+	if consumed != len(data) {
+		t.Errorf("consumed = %d, want %d", consumed, len(data))
+	}
+	if imei != "123456789012345" {
+		t.Errorf("deviceIMEI = %q, want 123456789012345", imei)
+	}
+	if len(sink.forwarded) != 1 {
+		t.Fatalf("forwarded %d positions, want 1", len(sink.forwarded))
+	}
+	if sink.forwarded[0].IMEI != "123456789012345" {
+		t.Errorf("forwarded IMEI = %q, want 123456789012345", sink.forwarded[0].IMEI)
+	}
+	if len(metrics.deviceInfos) != 1 || metrics.deviceInfos[0].Hardware != "G62" {
+		t.Fatalf("RecordDeviceInfo not called with parsed info: %+v", metrics.deviceInfos)
+	}
+
+	// hello and commit-request-style messages get an ack response; a bare
+	// version message doesn't.
+	if len(responses) != 1 {
+		t.Errorf("got %d responses, want 1 (hello ack only)", len(responses))
+	}
+}
@@ -0,0 +1,73 @@
+// Package protocol defines the interface tracker wire protocols implement so
+// that main.go can dispatch an accepted connection to the right parser
+// without knowing anything about its framing, and so every parser feeds the
+// same set of output sinks.
+package protocol
+
+import (
+	"net"
+	"time"
+)
+
+// Position is a GPS fix normalized to real-world units, decoupled from any
+// single protocol's wire encoding. Every PositionSink only needs to handle
+// this one shape.
+type Position struct {
+	IMEI        string
+	Time        time.Time
+	Latitude    float64
+	Longitude   float64
+	Altitude    float64 // meters
+	GroundSpeed float64 // knots
+	Heading     float64 // degrees, 0-360
+	PDOP        float64
+	Accuracy    float64 // meters
+	BatteryV    float64
+
+	// RawFrame is the wire bytes the protocol decoded this position from,
+	// kept around for sinks that archive raw traffic alongside parsed
+	// fields (e.g. the SQLite data log).
+	RawFrame []byte
+	// SourceIP is filled in by the dispatcher from the connection's remote
+	// address, not by the protocol itself.
+	SourceIP string
+}
+
+// PositionSink receives normalized positions decoded by any Protocol
+// implementation, e.g. to forward them to Traccar or broadcast them as
+// GDL90.
+type PositionSink interface {
+	Forward(pos Position) error
+}
+
+// DeviceInfo is device identification a protocol parsed out of band from
+// position data, e.g. Digital Matter's MSG_VERSION payload.
+type DeviceInfo struct {
+	IMEI     string
+	Hardware string
+	Firmware string
+	Serial   string
+}
+
+// Metrics receives bookkeeping events from a Protocol as it parses a
+// connection, so a management endpoint can report counts without the
+// protocol package knowing anything about how they're served.
+type Metrics interface {
+	// RecordMessage is called once per message/packet a Protocol parses,
+	// kind being a short protocol-specific label such as "data_records" or
+	// "hello".
+	RecordMessage(kind string)
+	// RecordDeviceInfo is called whenever a protocol identifies a device's
+	// hardware/firmware/serial.
+	RecordDeviceInfo(info DeviceInfo)
+}
+
+// Protocol implements framing and parsing for one tracker wire format.
+// Handle takes ownership of conn and should block for the lifetime of the
+// connection, decoding frames, forwarding fixes to sink and reporting
+// parsed messages to metrics.
+type Protocol interface {
+	Name() string
+	Detect(initial []byte) bool
+	Handle(conn net.Conn, sink PositionSink, metrics Metrics)
+}
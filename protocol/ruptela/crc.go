@@ -0,0 +1,20 @@
+package ruptela
+
+// crc16ARC implements CRC-16/ARC (poly 0xA001 reflected, init 0x0000), the
+// checksum Ruptela trackers append to every packet.
+func crc16ARC(data []byte) uint16 {
+	var crc uint16
+
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = (crc >> 1) ^ 0xA001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+
+	return crc
+}
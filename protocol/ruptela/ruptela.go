@@ -0,0 +1,189 @@
+// Package ruptela implements the Ruptela FM-series tracker wire protocol: a
+// length-prefixed record stream identified by an ASCII IMEI, with a
+// CRC16/ARC trailer and a fixed 4-byte acknowledgement.
+package ruptela
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"github.com/Saturn745/digitalmatter-traccar/protocol"
+)
+
+const (
+	cmdRecords      = 0x01
+	imeiFieldLen    = 8
+	recordHeaderLen = 4 + 1 + 4 + 4 + 2 + 2 + 1 + 2 + 1 // timestamp+priority+lat+lon+alt+angle+sats+speed+ioCount
+)
+
+var ackOK = []byte{0x00, 0x00, 0x00, 0x01}
+
+// Protocol is the ruptela.Protocol implementation.
+type Protocol struct{}
+
+// New returns a Ruptela protocol handler.
+func New() *Protocol {
+	return &Protocol{}
+}
+
+func (p *Protocol) Name() string {
+	return "ruptela"
+}
+
+// Detect sniffs the 2-byte big-endian packet length followed by an
+// ASCII-digit IMEI that every Ruptela packet opens with.
+func (p *Protocol) Detect(initial []byte) bool {
+	if len(initial) < 2+imeiFieldLen {
+		return false
+	}
+
+	for _, b := range initial[2 : 2+imeiFieldLen] {
+		if b < '0' || b > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (p *Protocol) Handle(conn net.Conn, sink protocol.PositionSink, metrics protocol.Metrics) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	var deviceIMEI string
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(10 * time.Minute))
+
+		lengthBuf, err := reader.Peek(2)
+		if err != nil {
+			if err != io.EOF && !isTimeout(err) {
+				log.Printf("ruptela: read error from %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		length := binary.BigEndian.Uint16(lengthBuf)
+
+		packet := make([]byte, 2+int(length))
+		if _, err := io.ReadFull(reader, packet); err != nil {
+			log.Printf("ruptela: short read from %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+
+		if err := handlePacket(packet, &deviceIMEI, sink, metrics); err != nil {
+			log.Printf("ruptela: %v from %s", err, conn.RemoteAddr())
+			continue
+		}
+
+		if _, err := conn.Write(ackOK); err != nil {
+			log.Printf("ruptela: write error to %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+func handlePacket(packet []byte, deviceIMEI *string, sink protocol.PositionSink, metrics protocol.Metrics) error {
+	body := packet[2:]
+	if len(body) < imeiFieldLen+2+2 {
+		return fmt.Errorf("packet too short")
+	}
+
+	trailer := packet[len(packet)-2:]
+	crc := binary.BigEndian.Uint16(trailer)
+	if crc != crc16ARC(packet[:len(packet)-2]) {
+		return fmt.Errorf("CRC mismatch")
+	}
+
+	if *deviceIMEI == "" {
+		*deviceIMEI = string(body[:imeiFieldLen])
+		log.Printf("ruptela: connection from IMEI: %s", *deviceIMEI)
+	}
+
+	cmd := body[imeiFieldLen]
+	if cmd != cmdRecords {
+		metrics.RecordMessage("unknown")
+		return nil
+	}
+	metrics.RecordMessage("records")
+
+	recordCount := int(body[imeiFieldLen+1])
+	records := body[imeiFieldLen+2 : len(body)-2]
+
+	offset := 0
+	for i := 0; i < recordCount; i++ {
+		record, consumed, err := parseRecord(records[offset:])
+		if err != nil {
+			return fmt.Errorf("record %d: %w", i, err)
+		}
+
+		if err := sink.Forward(toPosition(*deviceIMEI, record, records[offset:offset+consumed])); err != nil {
+			log.Printf("ruptela: sink forward error for IMEI %s: %v", *deviceIMEI, err)
+		}
+
+		offset += consumed
+	}
+
+	return nil
+}
+
+type record struct {
+	Timestamp  uint32
+	Priority   uint8
+	Latitude   int32
+	Longitude  int32
+	Altitude   uint16
+	Angle      uint16
+	Satellites uint8
+	Speed      uint16
+}
+
+func parseRecord(data []byte) (record, int, error) {
+	if len(data) < recordHeaderLen {
+		return record{}, 0, fmt.Errorf("truncated record header")
+	}
+
+	r := record{
+		Timestamp:  binary.BigEndian.Uint32(data[0:4]),
+		Priority:   data[4],
+		Latitude:   int32(binary.BigEndian.Uint32(data[5:9])),
+		Longitude:  int32(binary.BigEndian.Uint32(data[9:13])),
+		Altitude:   binary.BigEndian.Uint16(data[13:15]),
+		Angle:      binary.BigEndian.Uint16(data[15:17]),
+		Satellites: data[17],
+		Speed:      binary.BigEndian.Uint16(data[18:20]),
+	}
+
+	ioCount := int(data[20])
+	ioLen := ioCount * 2
+	consumed := recordHeaderLen + ioLen
+	if len(data) < consumed {
+		return record{}, 0, fmt.Errorf("truncated IO section")
+	}
+
+	return r, consumed, nil
+}
+
+func toPosition(imei string, r record, rawRecord []byte) protocol.Position {
+	return protocol.Position{
+		IMEI:        imei,
+		Time:        time.Unix(int64(r.Timestamp), 0),
+		Latitude:    float64(r.Latitude) / 10000000.0,
+		Longitude:   float64(r.Longitude) / 10000000.0,
+		Altitude:    float64(r.Altitude),
+		GroundSpeed: float64(r.Speed) * 0.539957,
+		Heading:     float64(r.Angle) / 100.0,
+		PDOP:        0,
+		Accuracy:    0,
+		RawFrame:    append([]byte{}, rawRecord...),
+	}
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
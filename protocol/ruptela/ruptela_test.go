@@ -0,0 +1,68 @@
+package ruptela
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestCRC16ARCKnownVector(t *testing.T) {
+	// "123456789" is the standard CRC-16/ARC check vector; its CRC is 0xBB3D.
+	const want = 0xBB3D
+	if got := crc16ARC([]byte("123456789")); got != want {
+		t.Errorf("crc16ARC(\"123456789\") = %#04x, want %#04x", got, want)
+	}
+
+	if got := crc16ARC(nil); got != 0 {
+		t.Errorf("crc16ARC(nil) = %#04x, want 0", got)
+	}
+}
+
+func TestParseRecord(t *testing.T) {
+	data := make([]byte, recordHeaderLen+2) // one IO element, 2 bytes
+
+	binary.BigEndian.PutUint32(data[0:4], 1700000000)
+	data[4] = 1 // priority
+	wantLat := int32(452345670)
+	wantLon := int32(-1226720000)
+	binary.BigEndian.PutUint32(data[5:9], uint32(wantLat))
+	binary.BigEndian.PutUint32(data[9:13], uint32(wantLon))
+	binary.BigEndian.PutUint16(data[13:15], 120)
+	binary.BigEndian.PutUint16(data[15:17], 9000)
+	data[17] = 8 // satellites
+	binary.BigEndian.PutUint16(data[18:20], 500)
+	data[20] = 1 // ioCount
+	data[recordHeaderLen] = 0x01
+	data[recordHeaderLen+1] = 0x02
+
+	r, consumed, err := parseRecord(data)
+	if err != nil {
+		t.Fatalf("parseRecord returned error: %v", err)
+	}
+	if consumed != len(data) {
+		t.Errorf("consumed = %d, want %d", consumed, len(data))
+	}
+	if r.Timestamp != 1700000000 {
+		t.Errorf("Timestamp = %d, want 1700000000", r.Timestamp)
+	}
+	if r.Latitude != 452345670 {
+		t.Errorf("Latitude = %d, want 452345670", r.Latitude)
+	}
+	if r.Longitude != -1226720000 {
+		t.Errorf("Longitude = %d, want -1226720000", r.Longitude)
+	}
+	if r.Satellites != 8 {
+		t.Errorf("Satellites = %d, want 8", r.Satellites)
+	}
+}
+
+func TestParseRecordTruncated(t *testing.T) {
+	if _, _, err := parseRecord(make([]byte, recordHeaderLen-1)); err == nil {
+		t.Fatal("expected an error for a truncated record header, got nil")
+	}
+
+	data := make([]byte, recordHeaderLen+1)
+	data[20] = 2 // claims 2 IO elements (4 bytes) but only 1 byte follows
+	if _, _, err := parseRecord(data); err == nil {
+		t.Fatal("expected an error for a truncated IO section, got nil")
+	}
+}
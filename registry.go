@@ -0,0 +1,216 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Saturn745/digitalmatter-traccar/protocol"
+)
+
+// deviceHistorySize is how many recent positions the registry keeps per
+// device for the /devices/{imei}/history endpoint.
+const deviceHistorySize = 500
+
+// deviceState is the registry's view of one tracker.
+type deviceState struct {
+	IMEI     string            `json:"imei"`
+	LastSeen time.Time         `json:"lastSeen"`
+	Position protocol.Position `json:"position"`
+	Hardware string            `json:"hardware,omitempty"`
+	Firmware string            `json:"firmware,omitempty"`
+	Serial   string            `json:"serial,omitempty"`
+
+	history    []protocol.Position
+	historyPos int
+}
+
+// Registry is a thread-safe store of server-wide stats and per-device state,
+// updated as protocols parse connections and positions are forwarded.
+type Registry struct {
+	mu        sync.RWMutex
+	startedAt time.Time
+
+	activeConnections int
+	bytesIn           uint64
+	bytesOut          uint64
+	messagesByType    map[string]uint64
+	forwardOK         uint64
+	forwardFail       uint64
+
+	devices map[string]*deviceState
+}
+
+func newRegistry() *Registry {
+	return &Registry{
+		startedAt:      time.Now(),
+		messagesByType: make(map[string]uint64),
+		devices:        make(map[string]*deviceState),
+	}
+}
+
+func (r *Registry) ConnectionOpened() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.activeConnections++
+}
+
+func (r *Registry) ConnectionClosed() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.activeConnections--
+}
+
+func (r *Registry) AddBytesIn(n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.bytesIn += uint64(n)
+}
+
+func (r *Registry) AddBytesOut(n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.bytesOut += uint64(n)
+}
+
+// RecordMessage implements protocol.Metrics.
+func (r *Registry) RecordMessage(kind string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.messagesByType[kind]++
+}
+
+func (r *Registry) RecordForward(ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if ok {
+		r.forwardOK++
+	} else {
+		r.forwardFail++
+	}
+}
+
+// RecordPosition updates a device's last-known state and appends to its
+// history ring buffer.
+func (r *Registry) RecordPosition(pos protocol.Position) {
+	if pos.IMEI == "" {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	dev, ok := r.devices[pos.IMEI]
+	if !ok {
+		dev = &deviceState{IMEI: pos.IMEI, history: make([]protocol.Position, 0, deviceHistorySize)}
+		r.devices[pos.IMEI] = dev
+	}
+
+	dev.LastSeen = time.Now()
+	dev.Position = pos
+
+	if len(dev.history) < deviceHistorySize {
+		dev.history = append(dev.history, pos)
+	} else {
+		dev.history[dev.historyPos] = pos
+		dev.historyPos = (dev.historyPos + 1) % deviceHistorySize
+	}
+}
+
+// RecordDeviceInfo implements protocol.Metrics, recording hardware/firmware
+// identification parsed from a device's MSG_VERSION payload.
+func (r *Registry) RecordDeviceInfo(info protocol.DeviceInfo) {
+	if info.IMEI == "" {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	dev, ok := r.devices[info.IMEI]
+	if !ok {
+		dev = &deviceState{IMEI: info.IMEI, history: make([]protocol.Position, 0, deviceHistorySize)}
+		r.devices[info.IMEI] = dev
+	}
+	dev.Hardware = info.Hardware
+	dev.Firmware = info.Firmware
+	dev.Serial = info.Serial
+}
+
+type statusResponse struct {
+	UptimeSeconds     float64           `json:"uptimeSeconds"`
+	ActiveConnections int               `json:"activeConnections"`
+	BytesIn           uint64            `json:"bytesIn"`
+	BytesOut          uint64            `json:"bytesOut"`
+	MessagesByType    map[string]uint64 `json:"messagesByType"`
+	ForwardOK         uint64            `json:"traccarForwardOK"`
+	ForwardFail       uint64            `json:"traccarForwardFail"`
+}
+
+func (r *Registry) Status() statusResponse {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	messagesByType := make(map[string]uint64, len(r.messagesByType))
+	for k, v := range r.messagesByType {
+		messagesByType[k] = v
+	}
+
+	return statusResponse{
+		UptimeSeconds:     time.Since(r.startedAt).Seconds(),
+		ActiveConnections: r.activeConnections,
+		BytesIn:           r.bytesIn,
+		BytesOut:          r.bytesOut,
+		MessagesByType:    messagesByType,
+		ForwardOK:         r.forwardOK,
+		ForwardFail:       r.forwardFail,
+	}
+}
+
+func (r *Registry) Devices() map[string]deviceState {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	out := make(map[string]deviceState, len(r.devices))
+	for imei, dev := range r.devices {
+		out[imei] = *dev
+	}
+	return out
+}
+
+// History returns the n most recent positions recorded for imei, oldest
+// first. ok is false if the device is unknown.
+func (r *Registry) History(imei string, n int) (positions []protocol.Position, ok bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	dev, found := r.devices[imei]
+	if !found {
+		return nil, false
+	}
+
+	ordered := make([]protocol.Position, len(dev.history))
+	if len(dev.history) < deviceHistorySize {
+		copy(ordered, dev.history)
+	} else {
+		copy(ordered, dev.history[dev.historyPos:])
+		copy(ordered[len(dev.history)-dev.historyPos:], dev.history[:dev.historyPos])
+	}
+
+	if n > 0 && n < len(ordered) {
+		ordered = ordered[len(ordered)-n:]
+	}
+
+	return ordered, true
+}
+
+// registrySink wraps a PositionSink so every forwarded position also updates
+// the registry's per-device state.
+type registrySink struct {
+	inner    protocol.PositionSink
+	registry *Registry
+}
+
+func (s *registrySink) Forward(pos protocol.Position) error {
+	s.registry.RecordPosition(pos)
+	return s.inner.Forward(pos)
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"compress/gzip"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/Saturn745/digitalmatter-traccar/protocol"
+)
+
+const createRecordsTableSQL = `
+CREATE TABLE IF NOT EXISTS records (
+	id           INTEGER PRIMARY KEY AUTOINCREMENT,
+	imei         TEXT NOT NULL,
+	source_ip    TEXT,
+	timestamp    INTEGER NOT NULL,
+	latitude     REAL,
+	longitude    REAL,
+	altitude     REAL,
+	ground_speed REAL,
+	heading      REAL,
+	pdop         REAL,
+	accuracy     REAL,
+	battery_v    REAL,
+	raw_hex      TEXT,
+	received_at  INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_records_imei_timestamp ON records (imei, timestamp);
+`
+
+// minFlushInterval floors StorageConfig.FlushInterval so a misconfigured
+// DATA_LOG_FLUSH_SECONDS (e.g. 0) can't hand time.NewTicker a non-positive
+// duration, which panics.
+const minFlushInterval = 1 * time.Second
+
+const insertRecordSQL = `
+INSERT INTO records (imei, source_ip, timestamp, latitude, longitude, altitude, ground_speed, heading, pdop, accuracy, battery_v, raw_hex, received_at)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+`
+
+// StorageConfig controls where parsed records are persisted and how
+// aggressively the backing SQLite file is rotated.
+type StorageConfig struct {
+	Path          string
+	MaxMB         int
+	MaxBackups    int
+	FlushRecords  int
+	FlushInterval time.Duration
+}
+
+// Storage persists every parsed Position to a SQLite database, batching
+// writes into periodic transactions and rotating the file once it grows
+// past MaxMB, in the style of lumberjack's size-based log rotation.
+type Storage struct {
+	mu      sync.Mutex
+	config  StorageConfig
+	db      *sql.DB
+	pending []protocol.Position
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func newStorage(config StorageConfig) (*Storage, error) {
+	if config.FlushInterval < minFlushInterval {
+		config.FlushInterval = minFlushInterval
+	}
+
+	s := &Storage{
+		config: config,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	if err := s.openLocked(); err != nil {
+		return nil, err
+	}
+
+	go s.flushLoop()
+
+	return s, nil
+}
+
+func (s *Storage) openLocked() error {
+	if dir := filepath.Dir(s.config.Path); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+
+	db, err := sql.Open("sqlite3", s.config.Path)
+	if err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(createRecordsTableSQL); err != nil {
+		db.Close()
+		return err
+	}
+
+	s.db = db
+	return nil
+}
+
+func (s *Storage) flushLoop() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.config.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.mu.Lock()
+			s.flushLocked()
+			s.mu.Unlock()
+		case <-s.stop:
+			s.mu.Lock()
+			s.flushLocked()
+			s.mu.Unlock()
+			return
+		}
+	}
+}
+
+// Record queues a position for the next batched write. It implements
+// protocol.PositionSink via storageSink.
+func (s *Storage) Record(pos protocol.Position) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pending = append(s.pending, pos)
+	if len(s.pending) >= s.config.FlushRecords {
+		s.flushLocked()
+	}
+}
+
+func (s *Storage) flushLocked() {
+	if len(s.pending) == 0 {
+		return
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		log.Printf("storage: begin transaction failed: %v", err)
+		return
+	}
+
+	stmt, err := tx.Prepare(insertRecordSQL)
+	if err != nil {
+		log.Printf("storage: prepare insert failed: %v", err)
+		tx.Rollback()
+		return
+	}
+
+	now := time.Now().Unix()
+	for _, pos := range s.pending {
+		_, err := stmt.Exec(
+			pos.IMEI, pos.SourceIP, pos.Time.Unix(),
+			pos.Latitude, pos.Longitude, pos.Altitude,
+			pos.GroundSpeed, pos.Heading, pos.PDOP, pos.Accuracy, pos.BatteryV,
+			hex.EncodeToString(pos.RawFrame), now,
+		)
+		if err != nil {
+			log.Printf("storage: insert failed for IMEI %s: %v", pos.IMEI, err)
+		}
+	}
+	stmt.Close()
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("storage: commit failed: %v", err)
+	}
+
+	s.pending = s.pending[:0]
+
+	s.rotateIfNeededLocked()
+}
+
+// rotateIfNeededLocked closes the active DB once it exceeds MaxMB, renames
+// it with a timestamp suffix, gzips the backup, prunes old backups beyond
+// MaxBackups, and opens a fresh DB file in its place.
+func (s *Storage) rotateIfNeededLocked() {
+	if s.config.MaxMB <= 0 {
+		return
+	}
+
+	info, err := os.Stat(s.config.Path)
+	if err != nil || info.Size() < int64(s.config.MaxMB)*1024*1024 {
+		return
+	}
+
+	if err := s.db.Close(); err != nil {
+		log.Printf("storage: close before rotate failed: %v", err)
+		return
+	}
+
+	backupPath := fmt.Sprintf("%s.%s", s.config.Path, time.Now().UTC().Format("20060102T150405"))
+	if err := os.Rename(s.config.Path, backupPath); err != nil {
+		log.Printf("storage: rotate rename failed: %v", err)
+	} else if err := gzipAndRemove(backupPath); err != nil {
+		log.Printf("storage: gzip backup failed: %v", err)
+	}
+
+	s.pruneBackupsLocked()
+
+	if err := s.openLocked(); err != nil {
+		log.Printf("storage: reopen after rotate failed: %v", err)
+	}
+}
+
+func gzipAndRemove(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(path + ".gz")
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(out)
+	if _, err := io.Copy(gz, in); err != nil {
+		gz.Close()
+		out.Close()
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+// pruneBackupsLocked keeps at most MaxBackups rotated files, oldest first by
+// the timestamp suffix rotateIfNeededLocked appends.
+func (s *Storage) pruneBackupsLocked() {
+	if s.config.MaxBackups <= 0 {
+		return
+	}
+
+	matches, err := filepath.Glob(s.config.Path + ".*")
+	if err != nil {
+		log.Printf("storage: listing backups failed: %v", err)
+		return
+	}
+	sort.Strings(matches)
+
+	if len(matches) <= s.config.MaxBackups {
+		return
+	}
+
+	for _, old := range matches[:len(matches)-s.config.MaxBackups] {
+		if err := os.Remove(old); err != nil {
+			log.Printf("storage: failed to prune backup %s: %v", old, err)
+		}
+	}
+}
+
+func (s *Storage) Close() error {
+	close(s.stop)
+	<-s.done
+	return s.db.Close()
+}
+
+// storageSink adapts Storage to protocol.PositionSink.
+type storageSink struct {
+	storage *Storage
+}
+
+func (s *storageSink) Forward(pos protocol.Position) error {
+	s.storage.Record(pos)
+	return nil
+}
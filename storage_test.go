@@ -0,0 +1,131 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/Saturn745/digitalmatter-traccar/protocol"
+)
+
+func TestStorageFlushLocked(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.db")
+	config := StorageConfig{Path: path, FlushRecords: 1000, FlushInterval: time.Hour}
+
+	storage, err := newStorage(config)
+	if err != nil {
+		t.Fatalf("newStorage failed: %v", err)
+	}
+	defer storage.Close()
+
+	storage.Record(protocol.Position{IMEI: "123456789012345", Latitude: 1, Longitude: 2, Time: time.Unix(1000, 0)})
+
+	storage.mu.Lock()
+	storage.flushLocked()
+	storage.mu.Unlock()
+
+	var count int
+	if err := storage.db.QueryRow("SELECT COUNT(*) FROM records").Scan(&count); err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	if count != 1 {
+		t.Errorf("got %d records after flush, want 1", count)
+	}
+}
+
+func TestStorageRotateIfNeededLocked(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.db")
+	config := StorageConfig{Path: path, MaxMB: 1, MaxBackups: 2, FlushRecords: 1000, FlushInterval: time.Hour}
+
+	storage, err := newStorage(config)
+	if err != nil {
+		t.Fatalf("newStorage failed: %v", err)
+	}
+	defer storage.Close()
+
+	// Push the file past the MaxMB threshold directly rather than inserting
+	// enough real rows to get there, which would make this test slow.
+	if err := os.Truncate(path, int64(config.MaxMB)*1024*1024+1); err != nil {
+		t.Fatalf("truncate failed: %v", err)
+	}
+
+	storage.mu.Lock()
+	storage.rotateIfNeededLocked()
+	storage.mu.Unlock()
+
+	backups, _ := filepath.Glob(path + ".*.gz")
+	if len(backups) != 1 {
+		t.Fatalf("got %d gzipped backups after rotation, want 1: %v", len(backups), backups)
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("expected a fresh db file at %s after rotation: %v", path, err)
+	}
+}
+
+func TestStorageRotateIfNeededLockedSkippedWhenMaxMBUnset(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.db")
+	config := StorageConfig{Path: path, FlushRecords: 1000, FlushInterval: time.Hour}
+
+	storage, err := newStorage(config)
+	if err != nil {
+		t.Fatalf("newStorage failed: %v", err)
+	}
+	defer storage.Close()
+
+	if err := os.Truncate(path, 2*1024*1024); err != nil {
+		t.Fatalf("truncate failed: %v", err)
+	}
+
+	storage.mu.Lock()
+	storage.rotateIfNeededLocked()
+	storage.mu.Unlock()
+
+	if backups, _ := filepath.Glob(path + ".*"); len(backups) != 0 {
+		t.Fatalf("rotation ran despite MaxMB <= 0: %v", backups)
+	}
+}
+
+func TestPruneBackupsLocked(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.db")
+	storage := &Storage{config: StorageConfig{Path: path, MaxBackups: 2}}
+
+	suffixes := []string{"20200101T000000", "20200102T000000", "20200103T000000", "20200104T000000"}
+	for _, suffix := range suffixes {
+		if err := os.WriteFile(path+"."+suffix, []byte("x"), 0644); err != nil {
+			t.Fatalf("write backup fixture failed: %v", err)
+		}
+	}
+
+	storage.pruneBackupsLocked()
+
+	remaining, _ := filepath.Glob(path + ".*")
+	sort.Strings(remaining)
+
+	want := []string{path + ".20200103T000000", path + ".20200104T000000"}
+	if len(remaining) != len(want) {
+		t.Fatalf("got %d backups after pruning, want %d: %v", len(remaining), len(want), remaining)
+	}
+	for i := range want {
+		if remaining[i] != want[i] {
+			t.Errorf("remaining[%d] = %s, want %s", i, remaining[i], want[i])
+		}
+	}
+}
+
+func TestPruneBackupsLockedSkippedWhenMaxBackupsUnset(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.db")
+	storage := &Storage{config: StorageConfig{Path: path}}
+
+	if err := os.WriteFile(path+".20200101T000000", []byte("x"), 0644); err != nil {
+		t.Fatalf("write backup fixture failed: %v", err)
+	}
+
+	storage.pruneBackupsLocked()
+
+	if backups, _ := filepath.Glob(path + ".*"); len(backups) != 1 {
+		t.Fatalf("pruning ran despite MaxBackups <= 0: %v", backups)
+	}
+}